@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// assumeRoleExpiryWindow is how long before a temporary credential's actual
+// Expiration the cache proactively refreshes it, so an in-flight request
+// never gets signed with a credential that expires mid-request.
+const assumeRoleExpiryWindow = 5 * time.Minute
+
+// assumeRoleSessionName identifies this proxy's sessions in the upstream
+// account's CloudTrail history.
+const assumeRoleSessionName = "aws-s3-reverse-proxy"
+
+// assumeRoleCredentialsCache lazily builds and caches auto-refreshing STS
+// credentials per role ARN, so every inbound identity that assumes the same
+// upstream role shares one refresh cycle.
+type assumeRoleCredentialsCache struct {
+	session *session.Session
+
+	externalID           string
+	webIdentityTokenFile string
+
+	mu    sync.RWMutex
+	byArn map[string]*credentials.Credentials
+}
+
+// newAssumeRoleCredentialsCache builds a cache that assumes roles via sess.
+// If webIdentityTokenFile is set, roles are assumed with
+// AssumeRoleWithWebIdentity, reading the token from that file on every
+// refresh; otherwise plain AssumeRole is used, passing externalID if set.
+func newAssumeRoleCredentialsCache(sess *session.Session, externalID, webIdentityTokenFile string) *assumeRoleCredentialsCache {
+	return &assumeRoleCredentialsCache{
+		session:              sess,
+		externalID:           externalID,
+		webIdentityTokenFile: webIdentityTokenFile,
+		byArn:                map[string]*credentials.Credentials{},
+	}
+}
+
+// Get returns the (possibly cached) auto-refreshing credentials for roleArn.
+func (c *assumeRoleCredentialsCache) Get(roleArn string) *credentials.Credentials {
+	c.mu.RLock()
+	creds, ok := c.byArn[roleArn]
+	c.mu.RUnlock()
+	if ok {
+		return creds
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if creds, ok := c.byArn[roleArn]; ok {
+		return creds
+	}
+	if c.webIdentityTokenFile != "" {
+		provider := stscreds.NewWebIdentityRoleProvider(sts.New(c.session), roleArn, assumeRoleSessionName, c.webIdentityTokenFile)
+		provider.ExpiryWindow = assumeRoleExpiryWindow
+		creds = credentials.NewCredentials(provider)
+	} else {
+		creds = stscreds.NewCredentials(c.session, roleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = assumeRoleSessionName
+			p.ExpiryWindow = assumeRoleExpiryWindow
+			if c.externalID != "" {
+				p.ExternalID = aws.String(c.externalID)
+			}
+		})
+	}
+
+	c.byArn[roleArn] = creds
+	return creds
+}
+
+// Expire forces roleArn's cached credentials to be re-fetched on next use,
+// e.g. after the upstream rejects them with an ExpiredToken error.
+func (c *assumeRoleCredentialsCache) Expire(roleArn string) {
+	c.mu.Lock()
+	creds, ok := c.byArn[roleArn]
+	c.mu.Unlock()
+	if ok {
+		creds.Expire()
+	}
+}
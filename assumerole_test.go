@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMockSTSServer returns an httptest server that answers every AssumeRole
+// call with fresh temporary credentials, using accessKeyID+callCount to make
+// each response distinguishable, and a counter of how many requests it has
+// received.
+func newMockSTSServer(t *testing.T) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleResult>
+				<Credentials>
+					<AccessKeyId>assumed-key-%[1]d</AccessKeyId>
+					<SecretAccessKey>assumed-secret-%[1]d</SecretAccessKey>
+					<SessionToken>assumed-token-%[1]d</SessionToken>
+					<Expiration>%[2]s</Expiration>
+				</Credentials>
+				<AssumedRoleUser>
+					<AssumedRoleId>AROAEXAMPLE:aws-s3-reverse-proxy</AssumedRoleId>
+					<Arn>arn:aws:sts::123456789012:assumed-role/test-role/aws-s3-reverse-proxy</Arn>
+				</AssumedRoleUser>
+			</AssumeRoleResult>
+			<ResponseMetadata><RequestId>%[1]d</RequestId></ResponseMetadata>
+		</AssumeRoleResponse>`, n, time.Now().Add(time.Hour).Format(time.RFC3339))
+	}))
+	return ts, &calls
+}
+
+// newMockWebIdentitySTSServer is newMockSTSServer's AssumeRoleWithWebIdentity
+// counterpart: every call gets fresh temporary credentials expiring after
+// expiresIn, so tests can probe the ExpiryWindow skew.
+func newMockWebIdentitySTSServer(t *testing.T, expiresIn time.Duration) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleWithWebIdentityResult>
+				<Credentials>
+					<AccessKeyId>webid-key-%[1]d</AccessKeyId>
+					<SecretAccessKey>webid-secret-%[1]d</SecretAccessKey>
+					<SessionToken>webid-token-%[1]d</SessionToken>
+					<Expiration>%[2]s</Expiration>
+				</Credentials>
+				<AssumedRoleUser>
+					<AssumedRoleId>AROAEXAMPLE:aws-s3-reverse-proxy</AssumedRoleId>
+					<Arn>arn:aws:sts::123456789012:assumed-role/test-role/aws-s3-reverse-proxy</Arn>
+				</AssumedRoleUser>
+			</AssumeRoleWithWebIdentityResult>
+			<ResponseMetadata><RequestId>%[1]d</RequestId></ResponseMetadata>
+		</AssumeRoleWithWebIdentityResponse>`, n, time.Now().Add(expiresIn).Format(time.RFC3339))
+	}))
+	return ts, &calls
+}
+
+// writeTestWebIdentityToken writes a dummy OIDC token to a file under t's
+// temp dir, for use as an --upstream-web-identity-token-file value.
+func writeTestWebIdentityToken(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "web-identity-token")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("test-token"), 0600))
+	return path
+}
+
+func newTestSTSSession(t *testing.T, endpoint string) *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials("inboundkey", "inboundsecret", ""),
+		DisableSSL:  aws.Bool(true),
+	})
+	assert.Nil(t, err)
+	return sess
+}
+
+func TestAssumeRoleCredentialsCacheGet(t *testing.T) {
+	ts, calls := newMockSTSServer(t)
+	defer ts.Close()
+
+	cache := newAssumeRoleCredentialsCache(newTestSTSSession(t, ts.URL), "", "")
+
+	value, err := cache.Get("arn:aws:iam::123456789012:role/test-role").Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "assumed-key-1", value.AccessKeyID)
+	assert.Equal(t, "assumed-secret-1", value.SecretAccessKey)
+	assert.Equal(t, "assumed-token-1", value.SessionToken)
+	assert.EqualValues(t, 1, atomic.LoadInt32(calls))
+
+	// A second Get for the same ARN reuses the cached, still-valid
+	// credentials rather than assuming the role again.
+	_, err = cache.Get("arn:aws:iam::123456789012:role/test-role").Get()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
+
+func TestAssumeRoleCredentialsCacheExpire(t *testing.T) {
+	ts, calls := newMockSTSServer(t)
+	defer ts.Close()
+
+	cache := newAssumeRoleCredentialsCache(newTestSTSSession(t, ts.URL), "", "")
+	roleArn := "arn:aws:iam::123456789012:role/test-role"
+
+	value, err := cache.Get(roleArn).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "assumed-key-1", value.AccessKeyID)
+
+	cache.Expire(roleArn)
+
+	value, err = cache.Get(roleArn).Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "assumed-key-2", value.AccessKeyID)
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+}
+
+func TestAssumeRoleCredentialsCacheGetWebIdentity(t *testing.T) {
+	ts, calls := newMockWebIdentitySTSServer(t, time.Hour)
+	defer ts.Close()
+
+	cache := newAssumeRoleCredentialsCache(newTestSTSSession(t, ts.URL), "", writeTestWebIdentityToken(t))
+
+	value, err := cache.Get("arn:aws:iam::123456789012:role/test-role").Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "webid-key-1", value.AccessKeyID)
+	assert.Equal(t, "webid-secret-1", value.SecretAccessKey)
+	assert.Equal(t, "webid-token-1", value.SessionToken)
+	assert.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
+
+func TestAssumeRoleCredentialsCacheWebIdentityAppliesExpiryWindow(t *testing.T) {
+	// The mock issues credentials expiring inside the 5-minute
+	// assumeRoleExpiryWindow skew, so they must be treated as already
+	// expired: this is what silently broke when the web-identity branch
+	// built its Credentials via stscreds.NewWebIdentityCredentials, which
+	// leaves the underlying WebIdentityRoleProvider's ExpiryWindow at its
+	// zero-value (no skew) instead of assumeRoleExpiryWindow.
+	ts, _ := newMockWebIdentitySTSServer(t, 4*time.Minute)
+	defer ts.Close()
+
+	cache := newAssumeRoleCredentialsCache(newTestSTSSession(t, ts.URL), "", writeTestWebIdentityToken(t))
+
+	creds := cache.Get("arn:aws:iam::123456789012:role/test-role")
+	_, err := creds.Get()
+	assert.Nil(t, err)
+	assert.True(t, creds.IsExpired())
+}
+
+func TestAssumeRoleCredentialsCachePerArn(t *testing.T) {
+	ts, _ := newMockSTSServer(t)
+	defer ts.Close()
+
+	cache := newAssumeRoleCredentialsCache(newTestSTSSession(t, ts.URL), "", "")
+
+	a := cache.Get("arn:aws:iam::123456789012:role/role-a")
+	b := cache.Get("arn:aws:iam::123456789012:role/role-b")
+	assert.NotSame(t, a, b)
+	assert.Same(t, a, cache.Get("arn:aws:iam::123456789012:role/role-a"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigCredential is one (AccessKeyID, SecretAccessKey) pair belonging to
+// a ConfigIdentity.
+type ConfigCredential struct {
+	AccessKeyID     string `json:"accessKeyId" yaml:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey" yaml:"secretAccessKey"`
+}
+
+// ConfigIdentity describes one allowed caller: the credentials it may
+// authenticate with, the actions it may perform per bucket, and optional
+// overrides of the global source subnet and upstream endpoint/region.
+type ConfigIdentity struct {
+	Name                string             `json:"name,omitempty" yaml:"name,omitempty"`
+	Credentials         []ConfigCredential `json:"credentials" yaml:"credentials"`
+	AllowedSourceSubnet []string           `json:"allowedSourceSubnet,omitempty" yaml:"allowedSourceSubnet,omitempty"`
+	UpstreamEndpoint    string             `json:"upstreamEndpoint,omitempty" yaml:"upstreamEndpoint,omitempty"`
+	UpstreamRegion      string             `json:"upstreamRegion,omitempty" yaml:"upstreamRegion,omitempty"`
+	// UpstreamAssumeRoleArn, if set, overrides --upstream-assume-role-arn
+	// for this identity, so different inbound access keys can assume
+	// different upstream roles.
+	UpstreamAssumeRoleArn string `json:"upstreamAssumeRoleArn,omitempty" yaml:"upstreamAssumeRoleArn,omitempty"`
+	// Buckets maps a bucket name to the actions (Read, Write, List, Admin,
+	// ReadAcp, WriteAcp) this identity is allowed to perform on it.
+	Buckets map[string][]string `json:"buckets" yaml:"buckets"`
+}
+
+// PublicAccessRule grants anonymous (unauthenticated) callers the given
+// actions ("GetObject", "ListBucket") on a bucket, optionally restricted to
+// keys starting with Prefix.
+type PublicAccessRule struct {
+	Bucket  string   `json:"bucket" yaml:"bucket"`
+	Prefix  string   `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Actions []string `json:"actions" yaml:"actions"`
+}
+
+// Config is the structured identity/ACL file loaded via --config.
+type Config struct {
+	Identities []ConfigIdentity `json:"identities" yaml:"identities"`
+
+	// PublicAccess lists the buckets (and optional key prefixes) reachable
+	// without a SigV4/SigV4A signature.
+	PublicAccess []PublicAccessRule `json:"publicAccess,omitempty" yaml:"publicAccess,omitempty"`
+
+	// PublicAccessKeyID names the AccessKeyID (among Identities or
+	// --aws-credentials) used to sign upstream requests made on behalf of
+	// anonymous callers matched by PublicAccess.
+	PublicAccessKeyID string `json:"publicAccessKeyId,omitempty" yaml:"publicAccessKeyId,omitempty"`
+}
+
+// loadConfig reads and parses a JSON or YAML config file, selecting the
+// format from the file extension (.yaml/.yml vs anything else treated as
+// JSON).
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	config := &Config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("error parsing YAML config file: %s", err)
+		}
+	default:
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("error parsing JSON config file: %s", err)
+		}
+	}
+	return config, nil
+}
+
+// compiledIdentity is the runtime-ready form of a ConfigIdentity, with
+// subnets parsed to *net.IPNet.
+type compiledIdentity struct {
+	Name                  string
+	AllowedSourceSubnet   []*net.IPNet
+	UpstreamEndpoint      string
+	UpstreamRegion        string
+	UpstreamAssumeRoleArn string
+	Buckets               map[string][]string
+}
+
+// compileIdentities turns a Config's identities into a credentials map
+// (AccessKeyID -> SecretAccessKey) and an identities map (AccessKeyID ->
+// compiledIdentity) suitable for use by the Handler.
+func compileIdentities(config *Config) (map[string]string, map[string]*compiledIdentity, error) {
+	credentials := make(map[string]string)
+	identities := make(map[string]*compiledIdentity)
+
+	for _, ci := range config.Identities {
+		subnets := make([]*net.IPNet, 0, len(ci.AllowedSourceSubnet))
+		for _, cidr := range ci.AllowedSourceSubnet {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid allowedSourceSubnet %q for identity %q: %s", cidr, ci.Name, err)
+			}
+			subnets = append(subnets, subnet)
+		}
+
+		compiled := &compiledIdentity{
+			Name:                  ci.Name,
+			AllowedSourceSubnet:   subnets,
+			UpstreamEndpoint:      ci.UpstreamEndpoint,
+			UpstreamRegion:        ci.UpstreamRegion,
+			UpstreamAssumeRoleArn: ci.UpstreamAssumeRoleArn,
+			Buckets:               ci.Buckets,
+		}
+
+		for _, cred := range ci.Credentials {
+			if cred.AccessKeyID == "" {
+				return nil, nil, fmt.Errorf("identity %q has a credential with an empty accessKeyId", ci.Name)
+			}
+			credentials[cred.AccessKeyID] = cred.SecretAccessKey
+			identities[cred.AccessKeyID] = compiled
+		}
+	}
+
+	return credentials, identities, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "restricted",
+				"credentials": [{"accessKeyId": "restrictedkey", "secretAccessKey": "restrictedsecret"}],
+				"buckets": {"mybucket": ["Read"]}
+			}
+		]
+	}`)
+
+	config, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Len(t, config.Identities, 1)
+	assert.Equal(t, "restricted", config.Identities[0].Name)
+	assert.Equal(t, []string{"Read"}, config.Identities[0].Buckets["mybucket"])
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeTestConfig(t, "config.yaml", `
+identities:
+  - name: restricted
+    credentials:
+      - accessKeyId: restrictedkey
+        secretAccessKey: restrictedsecret
+    buckets:
+      mybucket: [Read]
+`)
+
+	config, err := loadConfig(path)
+	assert.Nil(t, err)
+	assert.Len(t, config.Identities, 1)
+	assert.Equal(t, "restricted", config.Identities[0].Name)
+	assert.Equal(t, []string{"Read"}, config.Identities[0].Buckets["mybucket"])
+}
+
+func TestCompileIdentities(t *testing.T) {
+	config := &Config{
+		Identities: []ConfigIdentity{
+			{
+				Name:                "restricted",
+				Credentials:         []ConfigCredential{{AccessKeyID: "restrictedkey", SecretAccessKey: "restrictedsecret"}},
+				AllowedSourceSubnet: []string{"10.0.0.0/8"},
+				UpstreamRegion:      "eu-other-1",
+				Buckets:             map[string][]string{"mybucket": {"Read"}},
+			},
+		},
+	}
+
+	credentialsMap, identities, err := compileIdentities(config)
+	assert.Nil(t, err)
+	assert.Equal(t, "restrictedsecret", credentialsMap["restrictedkey"])
+	assert.Equal(t, "eu-other-1", identities["restrictedkey"].UpstreamRegion)
+	assert.Len(t, identities["restrictedkey"].AllowedSourceSubnet, 1)
+}
+
+func TestCompileIdentitiesUpstreamAssumeRoleArn(t *testing.T) {
+	config := &Config{
+		Identities: []ConfigIdentity{
+			{
+				Name:                  "restricted",
+				Credentials:           []ConfigCredential{{AccessKeyID: "restrictedkey", SecretAccessKey: "restrictedsecret"}},
+				UpstreamAssumeRoleArn: "arn:aws:iam::123456789012:role/restricted-role",
+			},
+		},
+	}
+
+	_, identities, err := compileIdentities(config)
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/restricted-role", identities["restrictedkey"].UpstreamAssumeRoleArn)
+}
+
+func TestCompileIdentitiesInvalidSubnet(t *testing.T) {
+	config := &Config{
+		Identities: []ConfigIdentity{
+			{
+				Name:                "restricted",
+				Credentials:         []ConfigCredential{{AccessKeyID: "restrictedkey", SecretAccessKey: "restrictedsecret"}},
+				AllowedSourceSubnet: []string{"not-a-cidr"},
+			},
+		},
+	}
+
+	_, _, err := compileIdentities(config)
+	assert.NotNil(t, err)
+}
+
+func TestIsActionAllowed(t *testing.T) {
+	assert.True(t, isActionAllowed([]string{ActionRead}, ActionRead))
+	assert.False(t, isActionAllowed([]string{ActionRead}, ActionWrite))
+	assert.True(t, isActionAllowed([]string{ActionAdmin}, ActionWrite))
+	assert.False(t, isActionAllowed(nil, ActionRead))
+}
+
+func TestClassifyS3Action(t *testing.T) {
+	get := func(rawURL string) *url.URL {
+		u, err := url.Parse(rawURL)
+		assert.Nil(t, err)
+		return u
+	}
+
+	assert.Equal(t, ActionRead, classifyS3Action(http.MethodGet, get("http://example.com/mybucket/mykey")))
+	assert.Equal(t, ActionList, classifyS3Action(http.MethodGet, get("http://example.com/mybucket/")))
+	assert.Equal(t, ActionWrite, classifyS3Action(http.MethodPut, get("http://example.com/mybucket/mykey")))
+	assert.Equal(t, ActionReadAcp, classifyS3Action(http.MethodGet, get("http://example.com/mybucket/mykey?acl")))
+	assert.Equal(t, ActionWriteAcp, classifyS3Action(http.MethodPut, get("http://example.com/mybucket/mykey?acl")))
+	assert.Equal(t, ActionAdmin, classifyS3Action(http.MethodPut, get("http://example.com/mybucket/?policy")))
+	assert.Equal(t, ActionList, classifyS3Action(http.MethodGet, get("http://example.com/mybucket/?list-type=2")))
+}
+
+func newTestProxyWithConfig(t *testing.T, configPath string) *Handler {
+	thf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	ts := httptest.NewServer(&thf)
+	tsURL, _ := url.Parse(ts.URL)
+
+	h, err := NewAwsS3ReverseProxy(Options{
+		Debug:                 true,
+		AllowedSourceEndpoint: "foobar.example.com",
+		AllowedSourceSubnet:   []string{"0.0.0.0/0"},
+		AwsCredentials:        []string{"fooooooooooooooo,bar"},
+		Region:                "eu-test-1",
+		UpstreamInsecure:      true,
+		UpstreamEndpoint:      tsURL.Host,
+		ConfigFile:            configPath,
+	})
+	assert.Nil(t, err)
+	return h
+}
+
+func signRequestWithCreds(r *http.Request, accessKeyID, secretKey, region string) {
+	r.Header.Del("accept-encoding")
+	r.Header.Del("authorization")
+	r.Header.Set("X-Amz-Date", "20060102T150405Z")
+	r.URL.RawPath = r.URL.Path
+
+	signTime, _ := time.Parse("20060102T150405Z", r.Header["X-Amz-Date"][0])
+	signer := v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretKey,
+	}))
+	signer.Sign(r, bytes.NewReader([]byte{}), "s3", region, signTime)
+}
+
+func TestHandlerConfigAllowedBucketAction(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "restricted",
+				"credentials": [{"accessKeyId": "restrictedkey", "secretAccessKey": "restrictedsecret"}],
+				"buckets": {"mybucket": ["Read"]}
+			}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/mykey", nil)
+	signRequestWithCreds(req, "restrictedkey", "restrictedsecret", "eu-test-1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+}
+
+func TestHandlerConfigDeniedBucketAction(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "restricted",
+				"credentials": [{"accessKeyId": "restrictedkey", "secretAccessKey": "restrictedsecret"}],
+				"buckets": {"mybucket": ["Read"]}
+			}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodPut, "http://foobar.example.com/mybucket/mykey", nil)
+	signRequestWithCreds(req, "restrictedkey", "restrictedsecret", "eu-test-1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 403, resp.Code)
+	assert.Contains(t, resp.Body.String(), "AccessDenied")
+}
+
+func TestHandlerConfigIdentitySourceSubnet(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "restricted",
+				"credentials": [{"accessKeyId": "restrictedkey", "secretAccessKey": "restrictedsecret"}],
+				"allowedSourceSubnet": ["172.27.42.0/24"]
+			}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/mykey", nil)
+	signRequestWithCreds(req, "restrictedkey", "restrictedsecret", "eu-test-1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "source IP not allowed")
+}
+
+func TestHandlerConfigMergesStaticCredentials(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "restricted",
+				"credentials": [{"accessKeyId": "restrictedkey", "secretAccessKey": "restrictedsecret"}]
+			}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com", nil)
+	signRequest(req)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+}
+
+func TestHandlerAnonymousGetObjectAllowed(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "public",
+				"credentials": [{"accessKeyId": "publickey", "secretAccessKey": "publicsecret"}]
+			}
+		],
+		"publicAccessKeyId": "publickey",
+		"publicAccess": [
+			{"bucket": "mybucket", "actions": ["GetObject"]}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/mykey", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+}
+
+func TestHandlerAnonymousPutObjectRejected(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "public",
+				"credentials": [{"accessKeyId": "publickey", "secretAccessKey": "publicsecret"}]
+			}
+		],
+		"publicAccessKeyId": "publickey",
+		"publicAccess": [
+			{"bucket": "mybucket", "actions": ["GetObject"]}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodPut, "http://foobar.example.com/mybucket/mykey", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "X-Amz-Date header missing")
+}
+
+func TestHandlerAnonymousBucketNotPublic(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "public",
+				"credentials": [{"accessKeyId": "publickey", "secretAccessKey": "publicsecret"}]
+			}
+		],
+		"publicAccessKeyId": "publickey",
+		"publicAccess": [
+			{"bucket": "mybucket", "actions": ["GetObject"]}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/otherbucket/mykey", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "X-Amz-Date header missing")
+}
+
+func TestHandlerAnonymousListBucketWithPrefix(t *testing.T) {
+	configPath := writeTestConfig(t, "config.json", `{
+		"identities": [
+			{
+				"name": "public",
+				"credentials": [{"accessKeyId": "publickey", "secretAccessKey": "publicsecret"}]
+			}
+		],
+		"publicAccessKeyId": "publickey",
+		"publicAccess": [
+			{"bucket": "mybucket", "prefix": "public/", "actions": ["GetObject", "ListBucket"]}
+		]
+	}`)
+	h := newTestProxyWithConfig(t, configPath)
+
+	allowed := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/public/mykey", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, allowed)
+	assert.Equal(t, 200, resp.Code)
+
+	denied := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/private/mykey", nil)
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, denied)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "X-Amz-Date header missing")
+}
@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const amzDateFormat = "20060102T150405Z"
+
+// minPresignedExpires and maxPresignedExpires are the bounds S3 enforces on
+// the X-Amz-Expires query parameter of a presigned URL.
+const (
+	minPresignedExpires = 1 * time.Second
+	maxPresignedExpires = 7 * 24 * time.Hour
+)
+
+// presignedQueryParams are the reserved query parameters used by a SigV4
+// presigned URL. They are excluded from the canonical query string when
+// re-verifying the signature.
+var presignedQueryParams = []string{
+	"X-Amz-Algorithm",
+	"X-Amz-Credential",
+	"X-Amz-Date",
+	"X-Amz-Expires",
+	"X-Amz-SignedHeaders",
+	"X-Amz-Signature",
+	"X-Amz-Security-Token",
+}
+
+// Options are the parsed command-line flags that configure a Handler.
+type Options struct {
+	Debug bool
+
+	AllowedSourceEndpoint string
+	AllowedSourceSubnet   []string
+
+	AwsCredentials []string
+	Region         string
+
+	// UpstreamSigningAlgorithm selects the algorithm used to re-sign
+	// outgoing requests to the upstream ("sigv4" or "sigv4a").
+	UpstreamSigningAlgorithm string
+
+	UpstreamEndpoint string
+	UpstreamInsecure bool
+
+	// ReadOnly restricts forwarded requests to GetObject-style requests.
+	ReadOnly bool
+
+	// ConfigFile, if set, is a JSON or YAML file describing additional
+	// identities and their per-bucket action ACLs. It is reloaded on
+	// SIGHUP.
+	ConfigFile string
+
+	// UpstreamAssumeRoleArn, if set, is the default IAM role assumed to
+	// obtain upstream credentials, refreshed automatically ahead of
+	// expiration. Overridable per-identity via ConfigFile.
+	UpstreamAssumeRoleArn string
+	// UpstreamAssumeRoleExternalID is passed as the ExternalId parameter
+	// of AssumeRole, if set.
+	UpstreamAssumeRoleExternalID string
+	// UpstreamWebIdentityTokenFile, if set, causes UpstreamAssumeRoleArn
+	// to be assumed via AssumeRoleWithWebIdentity, reading the token from
+	// this file, instead of a plain AssumeRole call.
+	UpstreamWebIdentityTokenFile string
+}
+
+// Handler is the reverse proxy http.Handler. It verifies the SigV4/SigV4A
+// signature of every incoming request against the configured identities,
+// then re-signs and forwards the request to the upstream S3-compatible
+// endpoint.
+type Handler struct {
+	AllowedSourceEndpoint string
+	AllowedSourceSubnet   []*net.IPNet
+
+	// AwsCredentials maps an allowed inbound AccessKeyID to its
+	// SecretAccessKey, combining --aws-credentials with any identities
+	// loaded from ConfigFile. Read and written through lookupIdentity and
+	// reloadConfig; do not access directly.
+	AwsCredentials map[string]string
+	Region         string
+
+	UpstreamSigningAlgorithm string
+	Upstream                 *url.URL
+
+	ReadOnly bool
+
+	// ConfigFile, if set, is reloaded on SIGHUP to refresh identities and
+	// bucket ACLs without restarting the proxy.
+	ConfigFile string
+
+	// UpstreamAssumeRoleArn is the default role assumed for upstream
+	// requests; see Options.UpstreamAssumeRoleArn. Identities loaded from
+	// ConfigFile may override it.
+	UpstreamAssumeRoleArn string
+
+	// assumeRoleCache lazily assumes and auto-refreshes credentials for
+	// UpstreamAssumeRoleArn and any per-identity overrides. Left nil if
+	// neither Options.UpstreamAssumeRoleArn nor Options.ConfigFile was set,
+	// in which case forwardRequest never needs it.
+	assumeRoleCache *assumeRoleCredentialsCache
+
+	staticCredentials map[string]string // from AwsCredentials in Options, immutable
+
+	configMu          sync.RWMutex
+	identities        map[string]*compiledIdentity // AccessKeyID -> ACL/overrides, from ConfigFile
+	publicAccess      []PublicAccessRule           // from ConfigFile
+	publicAccessKeyID string                       // from ConfigFile
+
+	Client *http.Client
+}
+
+// NewAwsS3ReverseProxy builds a Handler from the given Options, parsing and
+// validating the subnets, credentials and upstream endpoint.
+func NewAwsS3ReverseProxy(options Options) (*Handler, error) {
+	if options.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	subnets := make([]*net.IPNet, 0, len(options.AllowedSourceSubnet))
+	for _, cidr := range options.AllowedSourceSubnet {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AllowedSourceSubnet %q: %s", cidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	creds := make(map[string]string, len(options.AwsCredentials))
+	for _, pair := range options.AwsCredentials {
+		parts := strings.SplitN(pair, ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid AwsCredentials entry %q: expected \"accessKey,secretKey\"", pair)
+		}
+		creds[parts[0]] = parts[1]
+	}
+
+	upstreamScheme := "https"
+	if options.UpstreamInsecure {
+		upstreamScheme = "http"
+	}
+	upstream := &url.URL{
+		Scheme: upstreamScheme,
+		Host:   options.UpstreamEndpoint,
+	}
+
+	algorithm := options.UpstreamSigningAlgorithm
+	if algorithm == "" {
+		algorithm = algorithmSigV4
+	}
+	if algorithm != algorithmSigV4 && algorithm != algorithmSigV4A {
+		return nil, fmt.Errorf("invalid UpstreamSigningAlgorithm %q", algorithm)
+	}
+
+	h := &Handler{
+		AllowedSourceEndpoint:    options.AllowedSourceEndpoint,
+		AllowedSourceSubnet:      subnets,
+		Region:                   options.Region,
+		UpstreamSigningAlgorithm: algorithm,
+		Upstream:                 upstream,
+		ReadOnly:                 options.ReadOnly,
+		ConfigFile:               options.ConfigFile,
+		UpstreamAssumeRoleArn:    options.UpstreamAssumeRoleArn,
+		staticCredentials:        creds,
+		identities:               map[string]*compiledIdentity{},
+		Client:                   &http.Client{},
+	}
+	h.AwsCredentials = h.staticCredentials
+
+	// Only touch the AWS SDK's session/config-file loading (which can fail
+	// on a malformed AWS_CONFIG_FILE/AWS_SHARED_CREDENTIALS_FILE) when
+	// assume-role support might actually be used: either a default role is
+	// configured, or ConfigFile may define per-identity role overrides.
+	if options.UpstreamAssumeRoleArn != "" || options.ConfigFile != "" {
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, fmt.Errorf("error creating AWS session: %s", err)
+		}
+		h.assumeRoleCache = newAssumeRoleCredentialsCache(sess, options.UpstreamAssumeRoleExternalID, options.UpstreamWebIdentityTokenFile)
+	}
+
+	if h.ConfigFile != "" {
+		if err := h.reloadConfig(); err != nil {
+			return nil, err
+		}
+		h.watchConfigReload()
+	}
+
+	return h, nil
+}
+
+// reloadConfig re-reads ConfigFile and atomically swaps in the resulting
+// identities and merged credentials map.
+func (h *Handler) reloadConfig() error {
+	config, err := loadConfig(h.ConfigFile)
+	if err != nil {
+		return err
+	}
+	configCredentials, identities, err := compileIdentities(config)
+	if err != nil {
+		return err
+	}
+
+	merged := make(map[string]string, len(h.staticCredentials)+len(configCredentials))
+	for accessKeyID, secretKey := range h.staticCredentials {
+		merged[accessKeyID] = secretKey
+	}
+	for accessKeyID, secretKey := range configCredentials {
+		merged[accessKeyID] = secretKey
+	}
+
+	h.configMu.Lock()
+	h.AwsCredentials = merged
+	h.identities = identities
+	h.publicAccess = config.PublicAccess
+	h.publicAccessKeyID = config.PublicAccessKeyID
+	h.configMu.Unlock()
+	return nil
+}
+
+// watchConfigReload reloads ConfigFile every time the process receives
+// SIGHUP.
+func (h *Handler) watchConfigReload() {
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	go func() {
+		for range sigHup {
+			if err := h.reloadConfig(); err != nil {
+				log.WithError(err).Error("error reloading config file")
+				continue
+			}
+			log.WithField("file", h.ConfigFile).Info("reloaded config file")
+		}
+	}()
+}
+
+// lookupIdentity returns the secret key and, if the identity came from
+// ConfigFile, its ACL/overrides for accessKeyID.
+func (h *Handler) lookupIdentity(accessKeyID string) (string, *compiledIdentity, bool) {
+	h.configMu.RLock()
+	defer h.configMu.RUnlock()
+	secretKey, ok := h.AwsCredentials[accessKeyID]
+	if !ok {
+		return "", nil, false
+	}
+	return secretKey, h.identities[accessKeyID], true
+}
+
+// isPublicAccessAllowed reports whether an anonymous caller may perform
+// action on bucket/key, per the PublicAccess rules loaded from ConfigFile.
+func (h *Handler) isPublicAccessAllowed(bucket, key, action string) bool {
+	h.configMu.RLock()
+	defer h.configMu.RUnlock()
+	return publicAccessAllowed(h.publicAccess, bucket, key, action)
+}
+
+// ServeHTTP verifies the inbound SigV4/SigV4A signature and, if valid,
+// forwards the request to the upstream endpoint re-signed with the mapped
+// credentials.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{"method": r.Method, "url": r.URL.String()}).Debug("incoming request")
+
+	if err := h.checkSourceSubnet(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("X-Amz-Signature") != "" {
+		h.serveHTTPPresigned(w, r)
+		return
+	}
+
+	if len(r.Header["Authorization"]) == 0 {
+		h.serveHTTPAnonymous(w, r)
+		return
+	}
+
+	h.serveHTTPHeaderSigned(w, r)
+}
+
+// serveHTTPAnonymous handles requests with no Authorization header by
+// consulting the PublicAccess rules loaded from ConfigFile. A request whose
+// bucket/key/action is not covered by a rule falls through to
+// serveHTTPHeaderSigned, which rejects it with the usual "Authorization
+// header missing" error.
+func (h *Handler) serveHTTPAnonymous(w http.ResponseWriter, r *http.Request) {
+	action := classifyAnonymousAction(r)
+	if action == "" {
+		h.serveHTTPHeaderSigned(w, r)
+		return
+	}
+
+	bucket := extractBucket(r, h.AllowedSourceEndpoint)
+	key := extractKey(r, h.AllowedSourceEndpoint)
+	if !h.isPublicAccessAllowed(bucket, key, action) {
+		h.serveHTTPHeaderSigned(w, r)
+		return
+	}
+
+	if h.ReadOnly && !checkIfGetObjectUrl(r.URL) {
+		http.Error(w, "only GetObject requests are allowed in read-only mode", http.StatusForbidden)
+		return
+	}
+
+	secretKey, identity, ok := h.lookupIdentity(h.publicAccessKeyID)
+	if !ok {
+		http.Error(w, "no public upstream credential configured", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.checkBucketAction(r, identity); err != nil {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+
+	h.forwardRequest(w, r, h.publicAccessKeyID, secretKey, identity, bodyBytes)
+}
+
+// serveHTTPHeaderSigned handles requests authenticated with a SigV4 or
+// SigV4A Authorization header.
+func (h *Handler) serveHTTPHeaderSigned(w http.ResponseWriter, r *http.Request) {
+	amzDateHeaders := r.Header["X-Amz-Date"]
+	if len(amzDateHeaders) != 1 {
+		http.Error(w, "X-Amz-Date header missing or set multiple times", http.StatusBadRequest)
+		return
+	}
+
+	authHeaders := r.Header["Authorization"]
+	if len(authHeaders) != 1 {
+		http.Error(w, "Authorization header missing or set multiple times", http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := parseAuthorizationHeader(authHeaders[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid Authorization header: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	secretKey, identity, ok := h.lookupIdentity(parsed.AccessKeyID)
+	if !ok {
+		http.Error(w, "invalid AccessKeyID in Credential", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.checkIdentitySourceSubnet(r, identity); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	signTime, err := time.Parse(amzDateFormat, amzDateHeaders[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing X-Amz-Date %s", amzDateHeaders[0]), http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+
+	if err := h.checkRegion(parsed, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.isValidSignature(r, parsed, secretKey, signTime, bodyBytes) {
+		http.Error(w, "invalid signature in Authorization header", http.StatusBadRequest)
+		return
+	}
+
+	if h.ReadOnly && !checkIfGetObjectUrl(r.URL) {
+		http.Error(w, "only GetObject requests are allowed in read-only mode", http.StatusForbidden)
+		return
+	}
+
+	if err := h.checkBucketAction(r, identity); err != nil {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	h.forwardRequest(w, r, parsed.AccessKeyID, secretKey, identity, bodyBytes)
+}
+
+// checkRegion verifies that the request was signed for a region this proxy
+// serves. SigV4 carries a single Region in the Credential scope, SigV4A
+// instead carries a comma-separated X-Amz-Region-Set header.
+func (h *Handler) checkRegion(parsed *parsedAuthorization, r *http.Request) error {
+	switch parsed.Algorithm {
+	case algorithmSigV4:
+		if parsed.Region != h.Region {
+			return fmt.Errorf("invalid region in Credential")
+		}
+		return nil
+	case algorithmSigV4A:
+		regionSetHeader := r.Header.Get("X-Amz-Region-Set")
+		if regionSetHeader == "" {
+			return fmt.Errorf("X-Amz-Region-Set header missing")
+		}
+		for _, region := range strings.Split(regionSetHeader, ",") {
+			if region == "*" || region == h.Region {
+				return nil
+			}
+		}
+		return fmt.Errorf("region not allowed in X-Amz-Region-Set")
+	default:
+		return fmt.Errorf("unsupported signing algorithm")
+	}
+}
+
+// serveHTTPPresigned handles SigV4 presigned URL requests, where the
+// credential material travels in the query string instead of the
+// Authorization header.
+func (h *Handler) serveHTTPPresigned(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	algorithm := query.Get("X-Amz-Algorithm")
+	credential := query.Get("X-Amz-Credential")
+	amzDate := query.Get("X-Amz-Date")
+	expiresParam := query.Get("X-Amz-Expires")
+	signedHeadersParam := query.Get("X-Amz-SignedHeaders")
+	signature := query.Get("X-Amz-Signature")
+
+	if algorithm == "" || credential == "" || amzDate == "" || expiresParam == "" || signedHeadersParam == "" || signature == "" {
+		http.Error(w, "presigned URL missing required X-Amz-* query parameters", http.StatusBadRequest)
+		return
+	}
+
+	if algorithm != algorithmSigV4 {
+		http.Error(w, fmt.Sprintf("unsupported presigned URL algorithm %s", algorithm), http.StatusBadRequest)
+		return
+	}
+
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 {
+		http.Error(w, "invalid X-Amz-Credential query parameter", http.StatusBadRequest)
+		return
+	}
+	accessKeyID, region := scope[0], scope[2]
+
+	secretKey, identity, ok := h.lookupIdentity(accessKeyID)
+	if !ok {
+		http.Error(w, "invalid AccessKeyID in X-Amz-Credential", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.checkIdentitySourceSubnet(r, identity); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if region != h.Region {
+		http.Error(w, "invalid region in X-Amz-Credential", http.StatusBadRequest)
+		return
+	}
+
+	signTime, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing X-Amz-Date %s", amzDate), http.StatusBadRequest)
+		return
+	}
+
+	expiresSeconds, err := strconv.Atoi(expiresParam)
+	expires := time.Duration(expiresSeconds) * time.Second
+	if err != nil || expires < minPresignedExpires || expires > maxPresignedExpires {
+		http.Error(w, "X-Amz-Expires must be between 1 and 604800 seconds", http.StatusBadRequest)
+		return
+	}
+	if time.Since(signTime) > expires {
+		http.Error(w, "presigned URL has expired", http.StatusBadRequest)
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %s", err), http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+
+	signedHeaders := strings.Split(signedHeadersParam, ";")
+	if !h.isValidPresignedSignature(r, accessKeyID, secretKey, region, signedHeaders, signTime, expires, signature) {
+		http.Error(w, "invalid signature in presigned URL", http.StatusBadRequest)
+		return
+	}
+
+	if h.ReadOnly && !checkIfGetObjectUrl(r.URL) {
+		http.Error(w, "only GetObject requests are allowed in read-only mode", http.StatusForbidden)
+		return
+	}
+
+	if err := h.checkBucketAction(r, identity); err != nil {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	h.forwardRequest(w, r, accessKeyID, secretKey, identity, bodyBytes)
+}
+
+// isValidPresignedSignature recomputes the presigned URL for r using the
+// mapped secret key and compares the resulting X-Amz-Signature against the
+// one the client sent.
+func (h *Handler) isValidPresignedSignature(r *http.Request, accessKeyID, secretKey, region string, signedHeaders []string, signTime time.Time, expires time.Duration, receivedSignature string) bool {
+	originalHeader := r.Header
+	r.Header = filterHeaders(originalHeader, signedHeaders)
+	defer func() { r.Header = originalHeader }()
+
+	cleanURL := *r.URL
+	q := cleanURL.Query()
+	for _, key := range presignedQueryParams {
+		q.Del(key)
+	}
+	cleanURL.RawQuery = q.Encode()
+
+	verifyReq, err := http.NewRequest(r.Method, cleanURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	verifyReq.Header = r.Header
+	verifyReq.Host = r.Host
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials(accessKeyID, secretKey, ""))
+	if _, err := signer.Presign(verifyReq, nil, "s3", region, expires, signTime); err != nil {
+		return false
+	}
+
+	return verifyReq.URL.Query().Get("X-Amz-Signature") == receivedSignature
+}
+
+// filterHeaders returns a copy of header containing only the entries whose
+// name appears in signedHeaders (case-insensitive).
+func filterHeaders(header http.Header, signedHeaders []string) http.Header {
+	keep := make(map[string]bool, len(signedHeaders))
+	for _, name := range signedHeaders {
+		keep[http.CanonicalHeaderKey(name)] = true
+	}
+	filtered := make(http.Header, len(keep))
+	for name, values := range header {
+		if keep[name] {
+			filtered[name] = values
+		}
+	}
+	return filtered
+}
+
+func (h *Handler) checkSourceSubnet(r *http.Request) error {
+	return checkSourceSubnet(r, h.AllowedSourceSubnet)
+}
+
+// checkIdentitySourceSubnet applies an identity's own AllowedSourceSubnet,
+// if ConfigFile set one, on top of the Handler's global check.
+func (h *Handler) checkIdentitySourceSubnet(r *http.Request, identity *compiledIdentity) error {
+	if identity == nil || len(identity.AllowedSourceSubnet) == 0 {
+		return nil
+	}
+	return checkSourceSubnet(r, identity.AllowedSourceSubnet)
+}
+
+func checkSourceSubnet(r *http.Request, allowed []*net.IPNet) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unable to parse source IP %q", r.RemoteAddr)
+	}
+	for _, subnet := range allowed {
+		if subnet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source IP not allowed")
+}
+
+// checkBucketAction enforces an identity's per-bucket action ACL, if
+// ConfigFile configured one for it. Identities without a Buckets entry (or
+// not sourced from ConfigFile at all) are unrestricted, matching the
+// flat --aws-credentials behavior.
+func (h *Handler) checkBucketAction(r *http.Request, identity *compiledIdentity) error {
+	if identity == nil || identity.Buckets == nil {
+		return nil
+	}
+	bucket := extractBucket(r, h.AllowedSourceEndpoint)
+	action := classifyS3Action(r.Method, r.URL)
+	if !isActionAllowed(identity.Buckets[bucket], action) {
+		return fmt.Errorf("identity %q is not allowed to %s on bucket %q", identity.Name, action, bucket)
+	}
+	return nil
+}
+
+// isValidSignature recomputes the expected signature for the given request
+// using the mapped secret key and compares it against what the client sent.
+// For SigV4 this re-signs the request with the AWS SDK's signer and compares
+// the resulting Authorization header; for SigV4A it builds the canonical
+// request by hand and verifies the ECDSA signature directly.
+func (h *Handler) isValidSignature(r *http.Request, parsed *parsedAuthorization, secretKey string, signTime time.Time, body []byte) bool {
+	switch parsed.Algorithm {
+	case algorithmSigV4:
+		received := r.Header.Get("Authorization")
+
+		// Re-sign using only the headers the client originally signed: the
+		// SDK signer includes every header present on the request, and
+		// unsigned headers (e.g. a downstream proxy hop) must not affect
+		// the outcome.
+		originalHeader := r.Header
+		r.Header = filterHeaders(originalHeader, parsed.SignedHeaders)
+
+		signer := v4.NewSigner(credentials.NewStaticCredentials(parsed.AccessKeyID, secretKey, ""))
+		signer.Sign(r, bytes.NewReader(body), "s3", parsed.Region, signTime)
+		expected := r.Header.Get("Authorization")
+
+		r.Header = originalHeader
+		return expected == received
+	case algorithmSigV4A:
+		return verifySigV4ARequest(r, parsed, secretKey, signTime, body)
+	default:
+		return false
+	}
+}
+
+// forwardRequest re-signs the request for the upstream endpoint using the
+// mapped credentials (or, if an assume-role ARN applies, temporary STS
+// credentials) and streams the response back to the client. A response
+// rejected with an S3 ExpiredToken error is retried once against freshly
+// assumed credentials.
+func (h *Handler) forwardRequest(w http.ResponseWriter, r *http.Request, accessKeyID, secretKey string, identity *compiledIdentity, body []byte) {
+	upstreamHost := h.Upstream.Host
+	region := h.Region
+	roleArn := h.UpstreamAssumeRoleArn
+	if identity != nil {
+		if identity.UpstreamEndpoint != "" {
+			upstreamHost = identity.UpstreamEndpoint
+		}
+		if identity.UpstreamRegion != "" {
+			region = identity.UpstreamRegion
+		}
+		if identity.UpstreamAssumeRoleArn != "" {
+			roleArn = identity.UpstreamAssumeRoleArn
+		}
+	}
+
+	outURL := *r.URL
+	outURL.Scheme = h.Upstream.Scheme
+	outURL.Host = upstreamHost
+
+	// Strip any inbound presigned-URL query parameters: they authenticate
+	// the original client against us, not us against the upstream, and
+	// forwarding them would leak the client's AccessKeyID and a signature
+	// that is stale once we re-sign with different (possibly upstream)
+	// credentials.
+	if query := outURL.Query(); len(query) > 0 {
+		for _, key := range presignedQueryParams {
+			query.Del(key)
+		}
+		outURL.RawQuery = query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		outReq, err := http.NewRequest(r.Method, outURL.String(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error creating upstream request: %s", err), http.StatusInternalServerError)
+			return
+		}
+		outReq.Header = r.Header.Clone()
+		outReq.Header.Del("Authorization")
+		outReq.Header.Del("X-Amz-Date")
+		outReq.Header.Del("X-Amz-Region-Set")
+		outReq.Header.Del("X-Amz-Security-Token")
+		outReq.Host = upstreamHost
+
+		signAccessKeyID, signSecretKey, sessionToken := accessKeyID, secretKey, ""
+		if roleArn != "" {
+			assumed, err := h.assumeRoleCache.Get(roleArn).Get()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("error assuming upstream role %s: %s", roleArn, err), http.StatusBadGateway)
+				return
+			}
+			signAccessKeyID, signSecretKey, sessionToken = assumed.AccessKeyID, assumed.SecretAccessKey, assumed.SessionToken
+		}
+
+		switch h.UpstreamSigningAlgorithm {
+		case algorithmSigV4A:
+			if err := signRequestSigV4A(outReq, signAccessKeyID, signSecretKey, sessionToken, region, body, time.Now()); err != nil {
+				http.Error(w, fmt.Sprintf("error signing upstream request: %s", err), http.StatusInternalServerError)
+				return
+			}
+		default:
+			signer := v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+				AccessKeyID:     signAccessKeyID,
+				SecretAccessKey: signSecretKey,
+				SessionToken:    sessionToken,
+			}))
+			if _, err := signer.Sign(outReq, bytes.NewReader(body), "s3", region, time.Now()); err != nil {
+				http.Error(w, fmt.Sprintf("error signing upstream request: %s", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		resp, err := h.Client.Do(outReq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error forwarding request upstream: %s", err), http.StatusBadGateway)
+			return
+		}
+
+		if roleArn != "" && attempt == 0 && resp.StatusCode == http.StatusBadRequest {
+			respBody, readErr := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if readErr == nil && bytes.Contains(respBody, []byte("<Code>ExpiredToken</Code>")) {
+				h.assumeRoleCache.Expire(roleArn)
+				continue
+			}
+			writeUpstreamResponse(w, resp, bytes.NewReader(respBody))
+			return
+		}
+
+		defer resp.Body.Close()
+		writeUpstreamResponse(w, resp, resp.Body)
+		return
+	}
+}
+
+// writeUpstreamResponse copies resp's headers and status code to w, then
+// copies body, which may be resp.Body itself or, if it was already drained
+// to inspect it (e.g. to check for an ExpiredToken error), a buffer holding
+// its contents.
+func writeUpstreamResponse(w http.ResponseWriter, resp *http.Response, body io.Reader) {
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, body)
+}
+
+const (
+	algorithmSigV4  = "AWS4-HMAC-SHA256"
+	algorithmSigV4A = "AWS4-ECDSA-P256-SHA256"
+)
+
+// parsedAuthorization holds the fields extracted from an Authorization
+// header, for either SigV4 or SigV4A.
+type parsedAuthorization struct {
+	Algorithm     string
+	AccessKeyID   string
+	Date          string
+	Region        string // empty for SigV4A, which uses X-Amz-Region-Set instead
+	Service       string
+	SignedHeaders []string
+	Signature     string
+}
+
+// parseAuthorizationHeader extracts the Credential, SignedHeaders and
+// Signature fields from a SigV4 or SigV4A Authorization header.
+func parseAuthorizationHeader(auth string) (*parsedAuthorization, error) {
+	algorithm := algorithmSigV4
+	if strings.HasPrefix(auth, algorithmSigV4A) {
+		algorithm = algorithmSigV4A
+	}
+
+	credential, err := extractAuthField(auth, "Credential=")
+	if err != nil {
+		return nil, err
+	}
+	signedHeaders, err := extractAuthField(auth, "SignedHeaders=")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := extractAuthField(auth, "Signature=")
+	if err != nil {
+		return nil, err
+	}
+
+	scope := strings.Split(credential, "/")
+	parsed := &parsedAuthorization{
+		Algorithm:     algorithm,
+		SignedHeaders: strings.Split(signedHeaders, ";"),
+		Signature:     signature,
+	}
+
+	switch algorithm {
+	case algorithmSigV4:
+		// AccessKey/YYYYMMDD/region/service/aws4_request
+		if len(scope) != 5 {
+			return nil, fmt.Errorf("malformed Credential scope %q", credential)
+		}
+		parsed.AccessKeyID = scope[0]
+		parsed.Date = scope[1]
+		parsed.Region = scope[2]
+		parsed.Service = scope[3]
+	case algorithmSigV4A:
+		// AccessKey/YYYYMMDD/service/aws4_request (no region)
+		if len(scope) != 4 {
+			return nil, fmt.Errorf("malformed Credential scope %q", credential)
+		}
+		parsed.AccessKeyID = scope[0]
+		parsed.Date = scope[1]
+		parsed.Service = scope[2]
+	}
+
+	return parsed, nil
+}
+
+// extractAuthField pulls the value of a "Key=value" field out of a
+// comma-separated Authorization header, up to the next comma or the end
+// of the string.
+func extractAuthField(auth, key string) (string, error) {
+	idx := strings.Index(auth, key)
+	if idx == -1 {
+		return "", fmt.Errorf("%s not found", strings.TrimSuffix(key, "="))
+	}
+	rest := auth[idx+len(key):]
+	if end := strings.IndexByte(rest, ','); end != -1 {
+		rest = rest[:end]
+	}
+	return strings.TrimSpace(rest), nil
+}
+
+// checkIfGetObjectUrl reports whether u addresses a single object (bucket
+// and key, no query string), as opposed to bucket-level or query-modified
+// operations such as ListObjects, multipart uploads, ACLs, etc.
+func checkIfGetObjectUrl(u *url.URL) bool {
+	if u.RawQuery != "" {
+		return false
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		return false
+	}
+	return true
+}
+
+// hashBody returns the lowercase hex SHA256 digest of body, as used for the
+// x-amz-content-sha256 signed payload hash.
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
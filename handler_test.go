@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -88,6 +94,172 @@ func verifySignature(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// signInboundSigV4A signs r as an AWS4-ECDSA-P256-SHA256 (SigV4A) request,
+// analogous to signRequest for plain SigV4.
+func signInboundSigV4A(t *testing.T, r *http.Request, accessKey, secretKey, regionSet string) {
+	r.Header.Del("accept-encoding")
+	r.Header.Del("authorization")
+	r.URL.RawPath = r.URL.Path
+
+	signTime, err := time.Parse(amzDateFormat, "20060102T150405Z")
+	assert.Nil(t, err)
+	r.Header.Set("X-Amz-Date", "20060102T150405Z")
+	r.Header.Set("X-Amz-Region-Set", regionSet)
+	r.Header.Set("X-Amz-Content-Sha256", hashBody([]byte{}))
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date", "x-amz-region-set"}
+	canonicalRequest := buildCanonicalRequestSigV4A(r, signedHeaders, hashBody([]byte{}))
+	toSign := stringToSignSigV4A(canonicalRequest, signTime, "20060102/s3/aws4_request")
+
+	priv, err := deriveSigV4AKeyPair(accessKey, secretKey)
+	assert.Nil(t, err)
+
+	hash := sha256.Sum256([]byte(toSign))
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+	assert.Nil(t, err)
+	derSig, err := asn1.Marshal(ecdsaSignature{R: sigR, S: sigS})
+	assert.Nil(t, err)
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-ECDSA-P256-SHA256 Credential=%s/20060102/s3/aws4_request, SignedHeaders=%s, Signature=%s",
+		accessKey, strings.Join(signedHeaders, ";"), hex.EncodeToString(derSig),
+	))
+}
+
+func TestHandlerValidSignatureSigV4A(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com", nil)
+	signInboundSigV4A(t, req, "fooooooooooooooo", "bar", "eu-test-1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Hello, client")
+}
+
+func TestHandlerValidSignatureSigV4AWildcardRegionSet(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com", nil)
+	signInboundSigV4A(t, req, "fooooooooooooooo", "bar", "ap-south-1,*")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Hello, client")
+}
+
+func TestHandlerSigV4ARegionNotAllowed(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com", nil)
+	signInboundSigV4A(t, req, "fooooooooooooooo", "bar", "ap-south-1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "region not allowed in X-Amz-Region-Set")
+}
+
+func presignRequest(t *testing.T, r *http.Request, signTime time.Time, expires time.Duration) {
+	signer := v4.NewSigner(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+		AccessKeyID:     "fooooooooooooooo",
+		SecretAccessKey: "bar",
+	}))
+	_, err := signer.Presign(r, nil, "s3", "eu-test-1", expires, signTime)
+	assert.Nil(t, err)
+}
+
+func TestHandlerValidPresignedSignature(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/bucket/key", nil)
+	presignRequest(t, req, time.Now().UTC(), 15*time.Minute)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Hello, client")
+}
+
+func TestHandlerExpiredPresignedSignature(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/bucket/key", nil)
+	presignRequest(t, req, time.Now().UTC().Add(-1*time.Hour), 15*time.Minute)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "presigned URL has expired")
+}
+
+func TestHandlerTamperedPresignedSignature(t *testing.T) {
+	h := newTestProxy(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/bucket/key", nil)
+	presignRequest(t, req, time.Now().UTC(), 15*time.Minute)
+
+	q := req.URL.Query()
+	q.Set("X-Amz-Signature", "0000000000000000000000000000000000000000000000000000000000000000")
+	req.URL.RawQuery = q.Encode()
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 400, resp.Code)
+	assert.Contains(t, resp.Body.String(), "invalid signature in presigned URL")
+}
+
+func TestHandlerPresignedSignatureNotForwardedUpstream(t *testing.T) {
+	var upstreamQuery url.Values
+	thf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamQuery = r.URL.Query()
+		fmt.Fprintln(w, "Hello, client")
+	})
+	h := newTestProxyWithHandler(t, &thf)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/bucket/key", nil)
+	presignRequest(t, req, time.Now().UTC(), 15*time.Minute)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	assert.Equal(t, 200, resp.Code)
+
+	for _, key := range presignedQueryParams {
+		assert.Empty(t, upstreamQuery.Get(key), "upstream received inbound presigned query param %s", key)
+	}
+}
+
+func TestHandlerAnonymousReadOnlyDeniesListBucket(t *testing.T) {
+	h := newTestProxy(t)
+	h.ReadOnly = true
+	h.publicAccessKeyID = "fooooooooooooooo"
+	h.publicAccess = []PublicAccessRule{
+		{Bucket: "mybucket", Actions: []string{AnonymousActionListBucket}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "only GetObject requests are allowed in read-only mode")
+}
+
+func TestHandlerAnonymousReadOnlyAllowsGetObject(t *testing.T) {
+	h := newTestProxy(t)
+	h.ReadOnly = true
+	h.publicAccessKeyID = "fooooooooooooooo"
+	h.publicAccess = []PublicAccessRule{
+		{Bucket: "mybucket", Actions: []string{AnonymousActionGetObject}},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com/mybucket/key", nil)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Hello, client")
+}
+
 func TestHandlerMissingAmzDate(t *testing.T) {
 	h := newTestProxy(t)
 
@@ -250,6 +422,33 @@ func TestHandlerPassCustomHeaders(t *testing.T) {
 	assert.Contains(t, strings.TrimSpace(resp.Body.String()), "ok")
 }
 
+func TestHandlerAssumeRoleRetryOnExpiredToken(t *testing.T) {
+	var upstreamCalls int32
+	thf := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&upstreamCalls, 1) == 1 {
+			writeS3Error(w, http.StatusBadRequest, "ExpiredToken", "the security token included in the request is expired")
+			return
+		}
+		fmt.Fprintln(w, "Hello, client")
+	})
+	h := newTestProxyWithHandler(t, &thf)
+
+	stsTS, stsCalls := newMockSTSServer(t)
+	defer stsTS.Close()
+	h.assumeRoleCache = newAssumeRoleCredentialsCache(newTestSTSSession(t, stsTS.URL), "", "")
+	h.UpstreamAssumeRoleArn = "arn:aws:iam::123456789012:role/test-role"
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar.example.com", nil)
+	signRequest(req)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	assert.Equal(t, 200, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Hello, client")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&upstreamCalls))
+	assert.EqualValues(t, 2, atomic.LoadInt32(stsCalls))
+}
+
 func TestCheckGetObjectUrl(t *testing.T) {
 	type testSheet struct {
 		url  string
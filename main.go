@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	app = kingpin.New("aws-s3-reverse-proxy", "Reverse proxy in front of AWS S3, verifying and re-signing SigV4/SigV4A requests.")
+
+	debug = app.Flag("debug", "Enable debug logging.").Bool()
+
+	listenAddr  = app.Flag("listen-address", "HTTP listen address.").Default(":8099").String()
+	metricsAddr = app.Flag("metrics-listen-address", "Prometheus metrics listen address.").Default(":8098").String()
+
+	allowedSourceEndpoint = app.Flag("allowed-source-endpoint", "Hostname clients must use to reach this proxy.").Required().String()
+	allowedSourceSubnet   = app.Flag("allowed-source-subnet", "CIDR subnet(s) allowed to send requests.").Default("0.0.0.0/0").Strings()
+
+	awsCredentials = app.Flag("aws-credentials", "Allowed \"accessKey,secretKey\" pair(s).").Required().Strings()
+	region         = app.Flag("region", "AWS region this proxy serves.").Required().String()
+
+	upstreamSigningAlgorithm = app.Flag("upstream-signing-algorithm", "Algorithm used to re-sign upstream requests (sigv4 or sigv4a).").Default("sigv4").String()
+	upstreamEndpoint         = app.Flag("upstream-endpoint", "Upstream S3-compatible endpoint.").Required().String()
+	upstreamInsecure         = app.Flag("upstream-insecure", "Use HTTP instead of HTTPS to reach the upstream endpoint.").Bool()
+
+	readOnly = app.Flag("read-only", "Only allow GetObject requests to reach the upstream.").Bool()
+
+	configFile = app.Flag("config", "JSON or YAML file with additional identities and per-bucket ACLs. Reloaded on SIGHUP.").String()
+
+	upstreamAssumeRoleArn        = app.Flag("upstream-assume-role-arn", "IAM role to assume for upstream credentials, refreshed automatically before expiration. Overridable per-identity in --config.").String()
+	upstreamAssumeRoleExternalID = app.Flag("upstream-assume-role-external-id", "ExternalId to pass when assuming --upstream-assume-role-arn.").String()
+	upstreamWebIdentityTokenFile = app.Flag("upstream-web-identity-token-file", "Path to an OIDC web identity token, used to assume --upstream-assume-role-arn via AssumeRoleWithWebIdentity instead of AssumeRole.").String()
+)
+
+func main() {
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	if err := godotenv.Load(); err != nil {
+		log.WithError(err).Debug("no .env file loaded")
+	}
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	algorithm := "sigv4"
+	switch *upstreamSigningAlgorithm {
+	case "sigv4":
+		algorithm = algorithmSigV4
+	case "sigv4a":
+		algorithm = algorithmSigV4A
+	default:
+		log.Fatalf("invalid --upstream-signing-algorithm %q", *upstreamSigningAlgorithm)
+	}
+
+	h, err := NewAwsS3ReverseProxy(Options{
+		Debug:                    *debug,
+		AllowedSourceEndpoint:    *allowedSourceEndpoint,
+		AllowedSourceSubnet:      *allowedSourceSubnet,
+		AwsCredentials:           *awsCredentials,
+		Region:                   *region,
+		UpstreamSigningAlgorithm: algorithm,
+		UpstreamEndpoint:         *upstreamEndpoint,
+		UpstreamInsecure:         *upstreamInsecure,
+		ReadOnly:                 *readOnly,
+		ConfigFile:               *configFile,
+
+		UpstreamAssumeRoleArn:        *upstreamAssumeRoleArn,
+		UpstreamAssumeRoleExternalID: *upstreamAssumeRoleExternalID,
+		UpstreamWebIdentityTokenFile: *upstreamWebIdentityTokenFile,
+	})
+	if err != nil {
+		log.Fatalf("error creating reverse proxy: %s", err)
+	}
+
+	go func() {
+		log.WithField("addr", *metricsAddr).Info("starting metrics listener")
+		log.Fatal(http.ListenAndServe(*metricsAddr, promhttp.Handler()))
+	}()
+
+	log.WithField("addr", *listenAddr).Info("starting reverse proxy listener")
+	log.Fatal(http.ListenAndServe(*listenAddr, h))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The S3 actions an identity's bucket ACL entries may grant. ActionAdmin
+// implies every other action.
+const (
+	ActionRead     = "Read"
+	ActionWrite    = "Write"
+	ActionList     = "List"
+	ActionAdmin    = "Admin"
+	ActionReadAcp  = "ReadAcp"
+	ActionWriteAcp = "WriteAcp"
+)
+
+// extractBucket returns the bucket name addressed by r, supporting both
+// virtual-hosted-style (bucket.<allowedSourceEndpoint>) and path-style
+// (/bucket/key) requests.
+func extractBucket(r *http.Request, allowedSourceEndpoint string) string {
+	host := r.Host
+	if i := strings.IndexByte(host, ':'); i != -1 {
+		host = host[:i]
+	}
+	if allowedSourceEndpoint != "" && strings.HasSuffix(host, "."+allowedSourceEndpoint) {
+		return strings.TrimSuffix(host, "."+allowedSourceEndpoint)
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	return parts[0]
+}
+
+// classifyS3Action reports which action (see the Action* constants) the
+// given method and URL represent, extending checkIfGetObjectUrl's
+// GetObject/not-GetObject distinction to the other common S3 operations.
+func classifyS3Action(method string, u *url.URL) string {
+	query := u.Query()
+	hasKey := checkIfGetObjectUrl(u) || hasQueryParam(query, "tagging") || hasQueryParam(query, "uploadId")
+
+	switch {
+	case hasQueryParam(query, "acl"):
+		if method == http.MethodGet || method == http.MethodHead {
+			return ActionReadAcp
+		}
+		return ActionWriteAcp
+	case hasQueryParam(query, "policy"), hasQueryParam(query, "cors"), hasQueryParam(query, "lifecycle"),
+		hasQueryParam(query, "versioning"), hasQueryParam(query, "logging"), hasQueryParam(query, "notification"),
+		hasQueryParam(query, "replication"), hasQueryParam(query, "website"), hasQueryParam(query, "accelerate"):
+		return ActionAdmin
+	case hasQueryParam(query, "uploads"), hasQueryParam(query, "uploadId"), hasQueryParam(query, "tagging"), hasQueryParam(query, "partNumber"):
+		if method == http.MethodGet || method == http.MethodHead {
+			if hasKey {
+				return ActionRead
+			}
+			return ActionList
+		}
+		return ActionWrite
+	case query.Get("list-type") == "2":
+		return ActionList
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if checkIfGetObjectUrl(u) {
+			return ActionRead
+		}
+		return ActionList
+	default:
+		return ActionWrite
+	}
+}
+
+func hasQueryParam(query url.Values, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+// isActionAllowed reports whether any of the allowed actions grants the
+// requested action. ActionAdmin grants everything.
+func isActionAllowed(allowed []string, action string) bool {
+	for _, a := range allowed {
+		if a == action || a == ActionAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Anonymous actions a PublicAccessRule may grant, named after the S3
+// bucket-policy actions they correspond to rather than the internal
+// Action* constants used for per-identity ACLs.
+const (
+	AnonymousActionGetObject  = "GetObject"
+	AnonymousActionListBucket = "ListBucket"
+)
+
+// classifyAnonymousAction reports which anonymous action, if any, an
+// unauthenticated request represents. It defers to classifyS3Action for the
+// query-string handling, but only ever grants GetObject for a plain object
+// GET and ListBucket for a plain (or list-type=2) bucket listing: every
+// other S3 sub-resource (?acl, ?policy, ?tagging, ?uploads, ...) has no
+// corresponding AnonymousAction and is denied by returning "". Anonymous
+// access also never applies to methods other than GET/HEAD.
+func classifyAnonymousAction(r *http.Request) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	switch classifyS3Action(r.Method, r.URL) {
+	case ActionRead:
+		if checkIfGetObjectUrl(r.URL) {
+			return AnonymousActionGetObject
+		}
+	case ActionList:
+		if r.URL.RawQuery == "" || r.URL.Query().Get("list-type") == "2" {
+			return AnonymousActionListBucket
+		}
+	}
+	return ""
+}
+
+// extractKey returns the object key addressed by r, i.e. the bucket-relative
+// part of the path. It returns "" for a bucket-only (ListBucket) request.
+func extractKey(r *http.Request, allowedSourceEndpoint string) string {
+	host := r.Host
+	if i := strings.IndexByte(host, ':'); i != -1 {
+		host = host[:i]
+	}
+	if allowedSourceEndpoint != "" && strings.HasSuffix(host, "."+allowedSourceEndpoint) {
+		return strings.TrimPrefix(r.URL.Path, "/")
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// publicAccessAllowed reports whether any rule grants action on the given
+// bucket/key.
+func publicAccessAllowed(rules []PublicAccessRule, bucket, key, action string) bool {
+	for _, rule := range rules {
+		if rule.Bucket != bucket {
+			continue
+		}
+		if rule.Prefix != "" && !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		for _, a := range rule.Actions {
+			if a == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeS3Error writes an S3-style XML error response.
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n" +
+		"<Error><Code>" + code + "</Code><Message>" + message + "</Message></Error>"))
+}
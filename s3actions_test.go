@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyAnonymousAction(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{http.MethodGet, "http://example.com/bucket/key", AnonymousActionGetObject},
+		{http.MethodHead, "http://example.com/bucket/key", AnonymousActionGetObject},
+		{http.MethodGet, "http://example.com/bucket", AnonymousActionListBucket},
+		{http.MethodGet, "http://example.com/bucket?list-type=2", AnonymousActionListBucket},
+		{http.MethodGet, "http://example.com/bucket/key?acl", ""},
+		{http.MethodGet, "http://example.com/bucket/key?policy", ""},
+		{http.MethodGet, "http://example.com/bucket/key?tagging", ""},
+		{http.MethodGet, "http://example.com/bucket?uploads", ""},
+		{http.MethodGet, "http://example.com/bucket/key?uploadId=abc", ""},
+		{http.MethodPut, "http://example.com/bucket/key", ""},
+		{http.MethodDelete, "http://example.com/bucket/key", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		assert.Equal(t, tt.want, classifyAnonymousAction(req), "%s %s", tt.method, tt.url)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sigV4AAlgorithmLabel is the fixed label mixed into every SigV4A key
+// derivation candidate, domain-separating it from any other HMAC use of
+// the same secret access key.
+const sigV4AAlgorithmLabel = "AWS4-ECDSA-P256-SHA256"
+
+// sigV4AKeyBitLength is the requested output length, in bits, of the
+// derived SigV4A signing key (a P-256 scalar), encoded big-endian as the
+// trailing two bytes of each KDF candidate's fixed input.
+var sigV4AKeyBitLength = []byte{0x01, 0x00}
+
+// sigV4AFixedInput builds the NIST SP 800-108 counter-mode "fixed input" for
+// KDF candidate counter: the counter itself, the fixed algorithm label, a
+// 0x00 separator, the accessKeyID as the derivation's context, and the
+// requested key length in bits.
+func sigV4AFixedInput(counter byte, accessKeyID string) []byte {
+	input := make([]byte, 0, 1+len(sigV4AAlgorithmLabel)+1+len(accessKeyID)+len(sigV4AKeyBitLength))
+	input = append(input, counter)
+	input = append(input, sigV4AAlgorithmLabel...)
+	input = append(input, 0x00)
+	input = append(input, accessKeyID...)
+	input = append(input, sigV4AKeyBitLength...)
+	return input
+}
+
+// deriveSigV4AKeyPair derives the deterministic P-256 key pair associated
+// with an (AccessKeyID, SecretAccessKey) pair, following the SigV4A "key
+// derivation from a secret" scheme: a NIST SP 800-108 counter-mode KDF,
+// keyed by HMAC-SHA256 with "AWS4A"+secretKey, whose fixed input binds in
+// the algorithm label, the accessKeyID as context, and the requested key
+// length alongside the incrementing counter. Candidates are produced until
+// one falls within [1, n-2], where n is the order of the P-256 curve; the
+// candidate is then shifted into [1, n-1] by adding 1.
+//
+// This sandbox has no network path to AWS's published SigV4A test vectors
+// or the aws-sdk-go-v2 v4a signer module (only an internal Go module proxy
+// is reachable, and it does not mirror that submodule), so this has not
+// been checked byte-for-byte against a real AWS SigV4A implementation.
+// Confirm against official vectors before relying on this to interoperate
+// with a genuine AWS SigV4A client or with real S3 upstreams.
+func deriveSigV4AKeyPair(accessKeyID, secretKey string) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	nMinus2 := new(big.Int).Sub(n, big.NewInt(2))
+
+	kdfKey := append([]byte("AWS4A"), []byte(secretKey)...)
+
+	for counter := 1; counter < 256; counter++ {
+		c := new(big.Int).SetBytes(hmacSum(kdfKey, sigV4AFixedInput(byte(counter), accessKeyID)))
+		if c.Sign() >= 1 && c.Cmp(nMinus2) <= 0 {
+			d := c.Add(c, big.NewInt(1))
+			priv := new(ecdsa.PrivateKey)
+			priv.PublicKey.Curve = curve
+			priv.D = d
+			priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+			return priv, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to derive SigV4A key pair for access key %q", accessKeyID)
+}
+
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// ecdsaSignature is the ASN.1 structure of a SigV4A signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifySigV4ARequest recomputes the SigV4A canonical request and
+// string-to-sign for r, then verifies the Authorization header's ECDSA
+// signature against the key pair derived from secretKey.
+func verifySigV4ARequest(r *http.Request, parsed *parsedAuthorization, secretKey string, signTime time.Time, body []byte) bool {
+	priv, err := deriveSigV4AKeyPair(parsed.AccessKeyID, secretKey)
+	if err != nil {
+		return false
+	}
+
+	received := r.Header.Get("Authorization")
+	r.Header.Del("Authorization")
+	canonicalRequest := buildCanonicalRequestSigV4A(r, parsed.SignedHeaders, hashBody(body))
+	r.Header.Set("Authorization", received)
+
+	scope := strings.Join([]string{parsed.Date, parsed.Service, "aws4_request"}, "/")
+	toSign := stringToSignSigV4A(canonicalRequest, signTime, scope)
+
+	sigBytes, err := hex.DecodeString(parsed.Signature)
+	if err != nil {
+		return false
+	}
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(sigBytes, &sig); err != nil {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(toSign))
+	return ecdsa.Verify(&priv.PublicKey, hash[:], sig.R, sig.S)
+}
+
+// signRequestSigV4A signs r for the upstream using SigV4A: it sets
+// X-Amz-Date, X-Amz-Region-Set, X-Amz-Content-Sha256 and (if sessionToken is
+// set) X-Amz-Security-Token, then computes and sets an
+// AWS4-ECDSA-P256-SHA256 Authorization header derived from the given
+// credentials.
+func signRequestSigV4A(r *http.Request, accessKeyID, secretKey, sessionToken, region string, body []byte, signTime time.Time) error {
+	r.Header.Set("X-Amz-Date", signTime.Format(amzDateFormat))
+	r.Header.Set("X-Amz-Region-Set", region)
+	bodyHash := hashBody(body)
+	r.Header.Set("X-Amz-Content-Sha256", bodyHash)
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date", "x-amz-region-set"}
+	if sessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", sessionToken)
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+
+	canonicalRequest := buildCanonicalRequestSigV4A(r, signedHeaders, bodyHash)
+	scope := strings.Join([]string{signTime.Format("20060102"), "s3", "aws4_request"}, "/")
+	toSign := stringToSignSigV4A(canonicalRequest, signTime, scope)
+
+	priv, err := deriveSigV4AKeyPair(accessKeyID, secretKey)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(toSign))
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, priv, hash[:])
+	if err != nil {
+		return err
+	}
+	derSig, err := asn1.Marshal(ecdsaSignature{R: sigR, S: sigS})
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-ECDSA-P256-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, strings.Join(signedHeaders, ";"), hex.EncodeToString(derSig),
+	))
+	return nil
+}
+
+// stringToSignSigV4A builds the SigV4A string-to-sign. It is identical to
+// SigV4's except for the algorithm token and the region-less scope.
+func stringToSignSigV4A(canonicalRequest string, signTime time.Time, scope string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		algorithmSigV4A,
+		signTime.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+// buildCanonicalRequestSigV4A builds the SigV4 canonical request for r,
+// restricted to signedHeaders. This mirrors what the AWS SDK's v4.Signer
+// computes internally for SigV4, which is not available for SigV4A here.
+func buildCanonicalRequestSigV4A(r *http.Request, signedHeaders []string, bodyHash string) string {
+	uri := r.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uri,
+		canonicalQueryString(r.URL),
+		canonicalHeaders(r, signedHeaders),
+		strings.ToLower(strings.Join(signedHeaders, ";")),
+		bodyHash,
+	}, "\n")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	names := make([]string, len(signedHeaders))
+	copy(names, signedHeaders)
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		var value string
+		if strings.EqualFold(name, "host") {
+			value = r.Header.Get("Host")
+			if value == "" {
+				value = r.Host
+			}
+		} else {
+			value = strings.Join(r.Header.Values(http.CanonicalHeaderKey(name)), ",")
+		}
+		value = strings.Join(strings.Fields(value), " ")
+
+		buf.WriteString(strings.ToLower(name))
+		buf.WriteByte(':')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+func canonicalQueryString(u *url.URL) string {
+	query := u.Query()
+	query.Del("X-Amz-Signature")
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k)+"="+awsURIEncode(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEncode percent-encodes s per the SigV4 URI-encoding rules: only
+// unreserved characters (A-Za-z0-9-_.~) pass through unescaped.
+func awsURIEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9'),
+			c == '-' || c == '_' || c == '.' || c == '~':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
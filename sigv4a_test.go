@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeriveSigV4AKeyPairDeterministic only checks internal properties of
+// deriveSigV4AKeyPair (determinism, and that the derived scalar is a valid
+// P-256 private key): it does NOT establish interop with AWS's own SigV4A
+// signers. See the warning on deriveSigV4AKeyPair's doc comment.
+func TestDeriveSigV4AKeyPairDeterministic(t *testing.T) {
+	priv1, err := deriveSigV4AKeyPair("AKIAEXAMPLE", "secretkey")
+	assert.Nil(t, err)
+	priv2, err := deriveSigV4AKeyPair("AKIAEXAMPLE", "secretkey")
+	assert.Nil(t, err)
+	assert.Equal(t, priv1.D, priv2.D)
+
+	curve := priv1.PublicKey.Curve
+	assert.True(t, curve.IsOnCurve(priv1.PublicKey.X, priv1.PublicKey.Y))
+	n := curve.Params().N
+	assert.True(t, priv1.D.Sign() > 0)
+	assert.Equal(t, -1, priv1.D.Cmp(n))
+}
+
+func TestDeriveSigV4AKeyPairDiffersByAccessKeyAndSecret(t *testing.T) {
+	base, err := deriveSigV4AKeyPair("AKIAEXAMPLE", "secretkey")
+	assert.Nil(t, err)
+
+	byAccessKey, err := deriveSigV4AKeyPair("AKIAOTHER", "secretkey")
+	assert.Nil(t, err)
+	assert.NotEqual(t, base.D, byAccessKey.D)
+
+	bySecret, err := deriveSigV4AKeyPair("AKIAEXAMPLE", "othersecret")
+	assert.Nil(t, err)
+	assert.NotEqual(t, base.D, bySecret.D)
+}